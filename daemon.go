@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// sentinelPodEvents are the pub/sub channels we watch for changes relevant
+// to a managed pod's topology.
+var sentinelPodEvents = []string{
+	"+switch-master",
+	"+slave",
+	"+sdown",
+	"-sdown",
+	"+reboot",
+	"+convert-to-slave",
+}
+
+// runDaemon turns configsync into a long-running controller: it subscribes
+// to sentinel's pub/sub event stream and resyncs a pod as soon as sentinel
+// reports a topology change for it, in addition to a full sweep every
+// sweepInterval. It does not return: sentinel connection and subscribe
+// failures are retried with backoff.
+func runDaemon(sweepInterval time.Duration) error {
+	logger.Info("configsync: entering daemon mode")
+
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	go func() {
+		for range ticker.C {
+			sweepAllPods()
+		}
+	}()
+
+	backoff := time.Second
+	for {
+		sentinel, err := dialSentinel()
+		if err != nil {
+			logger.Warning(fmt.Sprintf("daemon: unable to connect to sentinel: %v (retrying in %s)", err, backoff))
+			time.Sleep(backoff)
+			backoff = nextBackoff(backoff)
+			continue
+		}
+		logger.Info("daemon: connected to sentinel at " + sentinel.addr)
+		backoff = time.Second
+
+		if err := sentinel.Subscribe(sentinelPodEvents...); err != nil {
+			logger.Warning("daemon: subscribe failed: " + err.Error())
+			sentinel.Close()
+			time.Sleep(backoff)
+			backoff = nextBackoff(backoff)
+			continue
+		}
+
+		for {
+			event, err := sentinel.NextMessage()
+			if err != nil {
+				logger.Warning("daemon: lost sentinel connection: " + err.Error())
+				break
+			}
+			if event.Channel == "" {
+				continue
+			}
+			handleSentinelEvent(event)
+		}
+		sentinel.Close()
+		time.Sleep(backoff)
+		backoff = nextBackoff(backoff)
+	}
+}
+
+// handleSentinelEvent resyncs whichever managed pod the event payload
+// refers to.
+func handleSentinelEvent(event SentinelEvent) {
+	fields := strings.Fields(event.Payload)
+	if len(fields) == 0 {
+		return
+	}
+	podName := sentinelEventPodName(fields)
+	pod, ok := sconfig.ManagedPodConfigs[podName]
+	if !ok {
+		return
+	}
+	logger.Info(fmt.Sprintf("daemon: sentinel event %s for pod %q, resyncing", event.Channel, podName))
+	if err := synchronizeConfigs(pod); err != nil {
+		logger.Warning(fmt.Sprintf("daemon: error resyncing pod %q after %s: %s", podName, event.Channel, err))
+	}
+}
+
+// sentinelEventPodName pulls the monitored pod's name out of a sentinel
+// pub/sub payload. +switch-master carries no instance-type prefix:
+// "<name> <old ip> <old port> <new ip> <new port>", so fields[0] is the
+// name. The other subscribed channels use "<instance-type> <name> <ip>
+// <port> [@ <master-name> <master-ip> <master-port>]": events about the
+// master itself omit the "@" clause and carry the name in fields[1], while
+// slave/sentinel events carry it right after the "@".
+func sentinelEventPodName(fields []string) string {
+	for i, f := range fields {
+		if f == "@" && i+1 < len(fields) {
+			return fields[i+1]
+		}
+	}
+	switch fields[0] {
+	case "master", "slave", "sentinel":
+		if len(fields) > 1 {
+			return fields[1]
+		}
+		return ""
+	default:
+		return fields[0]
+	}
+}
+
+// sweepAllPods runs synchronizeConfigs for every managed pod, same as the
+// one-shot mode.
+func sweepAllPods() {
+	for _, pod := range sconfig.ManagedPodConfigs {
+		if err := synchronizeConfigs(pod); err != nil {
+			logger.Warning(fmt.Sprintf("daemon: sweep error for pod %q: %s", pod.Name, err))
+		} else {
+			logger.Info("daemon: sweep synchronized " + pod.Name)
+		}
+	}
+}
+
+func nextBackoff(d time.Duration) time.Duration {
+	d *= 2
+	if d > 30*time.Second {
+		return 30 * time.Second
+	}
+	return d
+}
+
+// backoffSeed is the starting point for the tunnel mode reconnect backoff
+// loop; daemon mode starts from the same one second value inline.
+func backoffSeed() time.Duration {
+	return time.Second
+}
+
+func sleep(d time.Duration) {
+	time.Sleep(d)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// DesiredState is the optional declarative source of truth for syncable
+// directives, loaded from CONFIGSYNC_DESIREDSTATE instead of reading
+// whatever the live master happens to return from CONFIG GET.
+type DesiredState struct {
+	Defaults map[string]string            `yaml:"defaults" json:"defaults"`
+	Pods     map[string]map[string]string `yaml:"pods" json:"pods"`
+}
+
+// desiredState is populated at startup when CONFIGSYNC_DESIREDSTATE is set,
+// and left nil otherwise so synchronizeConfigs falls back to reading the
+// directives off the live master.
+var desiredState *DesiredState
+
+// loadDesiredState reads and parses path as YAML or JSON, detected by file
+// extension.
+func loadDesiredState(path string) (*DesiredState, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ds := &DesiredState{}
+	if strings.HasSuffix(path, ".json") {
+		err = json.Unmarshal(raw, ds)
+	} else {
+		err = yaml.Unmarshal(raw, ds)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse desired state file %s: %v", path, err)
+	}
+	return ds, nil
+}
+
+// directivesFor merges the defaults with any per-pod overrides for podName.
+func (ds *DesiredState) directivesFor(podName string) map[string]string {
+	merged := make(map[string]string, len(ds.Defaults))
+	for k, v := range ds.Defaults {
+		merged[k] = v
+	}
+	for k, v := range ds.Pods[podName] {
+		merged[k] = v
+	}
+	return merged
+}
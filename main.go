@@ -2,12 +2,17 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log/syslog"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/kelseyhightower/envconfig"
 	client "github.com/therealbill/libredis/client"
@@ -17,8 +22,27 @@ type LaunchConfig struct {
 	SentinelConfigFile    string
 	SyncableDirectiveList string
 	PretendOnly           bool
+	Daemon                bool
+	SweepInterval         int
+	SentinelAddrs         []string
+	DialTimeout           int
+	ReadTimeout           int
+	TLSCert               string `envconfig:"TLS_CERT"`
+	TLSKey                string `envconfig:"TLS_KEY"`
+	TLSCA                 string `envconfig:"TLS_CA"`
+	TLSServerName         string `envconfig:"TLS_SERVERNAME"`
+	TLSInsecureSkipVerify bool   `envconfig:"TLS_INSECURESKIPVERIFY"`
+	SentinelUsername      string `envconfig:"SENTINEL_USERNAME"`
+	SentinelPassword      string `envconfig:"SENTINEL_PASSWORD"`
+	DesiredStateFile      string `envconfig:"DESIREDSTATE"`
 }
 
+// diffMode mirrors the -diff CLI flag: when true, synchronizeConfigs prints
+// the directives that would change on each instance instead of applying
+// them. It is a richer version of the PretendOnly path, one that shows
+// current-vs-desired rather than just the values that would be pushed.
+var diffMode bool
+
 // SentinelPodConfig is a struct carrying information about a Pod's config as
 // pulled from the sentinel config file.
 type SentinelPodConfig struct {
@@ -27,6 +51,7 @@ type SentinelPodConfig struct {
 	Quorum    int
 	Name      string
 	AuthToken string
+	Username  string
 	Sentinels map[string]string
 }
 
@@ -38,6 +63,7 @@ type LocalSentinelConfig struct {
 	Port              int
 	ManagedPodConfigs map[string]SentinelPodConfig
 	Dir               string
+	TLSConfig         *tls.Config
 }
 
 var config LaunchConfig
@@ -85,6 +111,95 @@ func init() {
 	if config.SentinelConfigFile == "" {
 		config.SentinelConfigFile = "/etc/redis/sentinel.conf"
 	}
+	if config.SweepInterval == 0 {
+		config.SweepInterval = 300
+	}
+	if config.DialTimeout == 0 {
+		config.DialTimeout = 5
+	}
+	if config.ReadTimeout == 0 {
+		config.ReadTimeout = 5
+	}
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		logger.Crit(err.Error())
+		os.Exit(1)
+	}
+	sconfig.TLSConfig = tlsConfig
+	if config.DesiredStateFile != "" {
+		ds, err := loadDesiredState(config.DesiredStateFile)
+		if err != nil {
+			logger.Crit(err.Error())
+			os.Exit(1)
+		}
+		desiredState = ds
+	}
+}
+
+// loadTLSConfig builds a *tls.Config from the CONFIGSYNC_TLS_* settings,
+// loaded once at startup and reused for every Sentinel connection; Redis
+// connections go through dialRedis, which hands the file paths to libredis
+// instead. It returns nil (no TLS) if none of CONFIGSYNC_TLS_CERT,
+// CONFIGSYNC_TLS_KEY and CONFIGSYNC_TLS_CA is set.
+func loadTLSConfig() (*tls.Config, error) {
+	if config.TLSCert == "" && config.TLSKey == "" && config.TLSCA == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         config.TLSServerName,
+		InsecureSkipVerify: config.TLSInsecureSkipVerify,
+	}
+	if config.TLSCert != "" && config.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load TLS cert/key: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if config.TLSCA != "" {
+		caBytes, err := ioutil.ReadFile(config.TLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read TLS CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBytes) {
+			return nil, fmt.Errorf("unable to parse TLS CA %s", config.TLSCA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// dialRedis connects to a Redis instance at address using pc's credentials.
+// TLS settings come straight from the CONFIGSYNC_TLS_* config since
+// client.DialConfig takes raw cert/key/CA paths rather than a *tls.Config.
+// libredis has no username field on DialConfig: ACL auth is done post-dial
+// via AuthWithUser, so a Username on pc skips the dial-time Password and
+// authenticates afterward instead.
+func dialRedis(address string, pc SentinelPodConfig) (*client.Redis, error) {
+	cfg := &client.DialConfig{
+		Address:    address,
+		UseSSL:     config.TLSCert != "" || config.TLSKey != "" || config.TLSCA != "",
+		SkipVerify: config.TLSInsecureSkipVerify,
+		CAFile:     config.TLSCA,
+		CertFile:   config.TLSCert,
+		KeyFile:    config.TLSKey,
+		ServerName: config.TLSServerName,
+	}
+	if pc.Username == "" {
+		cfg.Password = pc.AuthToken
+	}
+	conn, err := client.DialWithConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if pc.Username != "" {
+		if err := conn.AuthWithUser(pc.Username, pc.AuthToken); err != nil {
+			conn.ClosePool()
+			return nil, fmt.Errorf("ACL auth as %q: %v", pc.Username, err)
+		}
+	}
+	return conn, nil
 }
 
 // extractSentinelDirective parses the sentinel directives from the
@@ -111,6 +226,13 @@ func extractSentinelDirective(entries []string) error {
 		sconfig.ManagedPodConfigs[pname] = pc
 		return nil
 
+	case "auth-user":
+		pname := entries[1]
+		pc := sconfig.ManagedPodConfigs[pname]
+		pc.Username = entries[2]
+		sconfig.ManagedPodConfigs[pname] = pc
+		return nil
+
 	case "config-epoch", "leader-epoch", "current-epoch", "down-after-milliseconds", "known-sentinel", "known-slave":
 		// We don't use these keys
 		return nil
@@ -173,9 +295,26 @@ func LoadSentinelConfigFile() error {
 	}
 }
 
+// synchronizeConfigs asks the local sentinel who the current master and
+// slaves for pc are (the `monitor` line in sentinel.conf is only used to
+// seed the pod name and credentials) and propagates the syncable directives
+// from the master to each reachable slave. When a desired-state file is
+// loaded, the directives come from it instead and are applied to the master
+// first, followed by CONFIG REWRITE on each instance; in -diff mode the
+// differences are only reported.
 func synchronizeConfigs(pc SentinelPodConfig) error {
-	address := fmt.Sprintf("%s:%d", pc.IP, pc.Port)
-	master, err := client.DialWithConfig(&client.DialConfig{Address: address, Password: pc.AuthToken})
+	sentinel, err := dialSentinel()
+	if err != nil {
+		return fmt.Errorf("unable to reach sentinel: %v", err)
+	}
+	defer sentinel.Close()
+
+	masterIP, masterPort, err := sentinel.GetMasterAddrByName(pc.Name)
+	if err != nil {
+		return fmt.Errorf("unable to resolve master for pod %q: %v", pc.Name, err)
+	}
+	address := fmt.Sprintf("%s:%d", masterIP, masterPort)
+	master, err := dialRedis(address, pc)
 	if err != nil {
 		return err
 	}
@@ -187,34 +326,142 @@ func synchronizeConfigs(pc SentinelPodConfig) error {
 		err := fmt.Errorf("Listed master does not have role 'master'. Aborting for safety")
 		return err
 	}
-	directivesToSync := make(map[string]string)
-	for _, d := range syncableDirectives {
-		cv, _ := master.ConfigGet(d)
-		directivesToSync[d] = cv[d]
+	var directivesToSync map[string]string
+	if desiredState != nil {
+		directivesToSync = desiredState.directivesFor(pc.Name)
+	} else {
+		directivesToSync = make(map[string]string)
+		for _, d := range syncableDirectives {
+			cv, _ := master.ConfigGet(d)
+			directivesToSync[d] = cv[d]
+		}
 	}
-	for _, s := range info.Replication.Slaves {
-		sadd := fmt.Sprintf("%s:%d", s.IP, s.Port)
+
+	if diffMode {
+		reportDiff(address, master, directivesToSync)
+	} else if desiredState != nil {
 		if config.PretendOnly {
-			logger.Info(fmt.Sprintf("WOULD Sync: %s => %s '%+v'", address, sadd, directivesToSync))
+			reportDiff(address, master, directivesToSync)
 		} else {
-			logger.Info(fmt.Sprintf("Sync: %s => %s", address, sadd))
-			slave, err := client.DialWithConfig(&client.DialConfig{Address: sadd, Password: pc.AuthToken})
-			if err != nil {
-				logger.Warning("Unable to connecte to slave: " + err.Error())
+			if err := applyDirectives(master, directivesToSync); err != nil {
+				return fmt.Errorf("applying desired state to master %s: %v", address, err)
 			}
-			for k, v := range directivesToSync {
-				err := slave.ConfigSet(k, v)
-				if err != nil {
-					logger.Warning("Err on config set: " + err.Error())
-				}
+			if err := verifyDirectives(master, directivesToSync); err != nil {
+				logger.Warning(fmt.Sprintf("Desired state verification failed on master %s: %s", address, err))
+			}
+			if err := master.ConfigRewrite(); err != nil {
+				logger.Warning("CONFIG REWRITE failed on master " + address + ": " + err.Error())
+			}
+		}
+	}
+
+	slaves, err := sentinel.Slaves(pc.Name)
+	if err != nil {
+		return fmt.Errorf("unable to list slaves for pod %q: %v", pc.Name, err)
+	}
+	for _, s := range slaves {
+		sadd := fmt.Sprintf("%s:%d", s.IP, s.Port)
+		if s.Down() {
+			logger.Warning(fmt.Sprintf("Skipping slave %s for pod %q: sentinel reports flags=%s", sadd, pc.Name, s.Flags))
+			continue
+		}
+		slave, err := dialRedis(sadd, pc)
+		if err != nil {
+			logger.Warning("Unable to connecte to slave: " + err.Error())
+			continue
+		}
+		if diffMode {
+			reportDiff(sadd, slave, directivesToSync)
+			continue
+		}
+		if config.PretendOnly {
+			logger.Info(fmt.Sprintf("WOULD Sync: %s => %s '%+v'", address, sadd, directivesToSync))
+			continue
+		}
+		logger.Info(fmt.Sprintf("Sync: %s => %s", address, sadd))
+		if err := applyDirectives(slave, directivesToSync); err != nil {
+			logger.Warning("Err on config set: " + err.Error())
+			continue
+		}
+		if desiredState != nil {
+			if err := slave.ConfigRewrite(); err != nil {
+				logger.Warning("CONFIG REWRITE failed on slave " + sadd + ": " + err.Error())
 			}
 		}
 	}
 	return nil
 }
 
+// configurable is satisfied by the redis connection type returned from
+// client.DialWithConfig; it lets applyDirectives/verifyDirectives/reportDiff
+// operate on either a master or a slave connection.
+type configurable interface {
+	ConfigGet(string) (map[string]string, error)
+	ConfigSet(string, string) error
+	ConfigRewrite() error
+}
+
+// applyDirectives issues CONFIG SET for every directive against inst,
+// returning the first error encountered.
+func applyDirectives(inst configurable, directives map[string]string) error {
+	for k, v := range directives {
+		if err := inst.ConfigSet(k, v); err != nil {
+			return fmt.Errorf("%s: %v", k, err)
+		}
+	}
+	return nil
+}
+
+// verifyDirectives re-reads each directive from inst via CONFIG GET and
+// confirms it matches what was just applied.
+func verifyDirectives(inst configurable, directives map[string]string) error {
+	for k, want := range directives {
+		cv, err := inst.ConfigGet(k)
+		if err != nil {
+			return fmt.Errorf("%s: %v", k, err)
+		}
+		if got := cv[k]; got != want {
+			return fmt.Errorf("%s: wanted %q, got %q", k, want, got)
+		}
+	}
+	return nil
+}
+
+// reportDiff prints, for a single instance, the directives whose current
+// value differs from the desired one, without applying anything.
+func reportDiff(address string, inst configurable, directivesToSync map[string]string) {
+	for k, want := range directivesToSync {
+		cv, _ := inst.ConfigGet(k)
+		if got := cv[k]; got != want {
+			logger.Info(fmt.Sprintf("DIFF %s: %s current=%q desired=%q", address, k, got, want))
+		}
+	}
+}
+
 func main() {
 	LoadSentinelConfigFile()
+
+	if len(os.Args) > 1 && os.Args[1] == "tunnel" {
+		if err := runTunnelCommand(os.Args[2:]); err != nil {
+			logger.Crit(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	daemon := flag.Bool("daemon", false, "run continuously, reacting to sentinel pub/sub events instead of syncing once and exiting")
+	diff := flag.Bool("diff", false, "print the directives that would change on each instance without applying them")
+	flag.Parse()
+	diffMode = *diff
+
+	if *daemon || config.Daemon {
+		if err := runDaemon(time.Duration(config.SweepInterval) * time.Second); err != nil {
+			logger.Crit(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
 	for _, pod := range sconfig.ManagedPodConfigs {
 		err := synchronizeConfigs(pod)
 		if err != nil {
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SentinelSlaveInfo carries the fields we care about from a single entry of
+// `SENTINEL slaves <name>`.
+type SentinelSlaveInfo struct {
+	IP    string
+	Port  int
+	Flags string
+}
+
+// Down reports whether sentinel has this slave marked unreachable.
+func (s SentinelSlaveInfo) Down() bool {
+	return strings.Contains(s.Flags, "s_down") || strings.Contains(s.Flags, "o_down")
+}
+
+// SentinelClient is a small RESP client for talking to a local sentinel,
+// modeled loosely on go-redis' FailoverOptions/NewFailoverClient: it knows
+// only enough of the protocol to PING and AUTH, ask sentinel who the
+// master/slaves are for a given pod, and follow its pub/sub event stream.
+type SentinelClient struct {
+	addr string
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// NewSentinelClient dials the sentinel at addr (host:port).
+func NewSentinelClient(addr string) (*SentinelClient, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &SentinelClient{addr: addr, conn: conn, rd: bufio.NewReader(conn)}, nil
+}
+
+// Close releases the underlying connection.
+func (s *SentinelClient) Close() error {
+	return s.conn.Close()
+}
+
+// do issues a command using the RESP multi-bulk request format and returns
+// the raw reply.
+func (s *SentinelClient) do(args ...string) (interface{}, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := s.conn.Write([]byte(b.String())); err != nil {
+		return nil, err
+	}
+	return s.readReply()
+}
+
+func (s *SentinelClient) readReply() (interface{}, error) {
+	line, err := s.rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) == 0 {
+		return nil, fmt.Errorf("sentinel: empty reply line")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("sentinel: %s", line[1:])
+	case ':':
+		return strconv.Atoi(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := fullRead(s.rd, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := 0; i < n; i++ {
+			item, err := s.readReply()
+			if err != nil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("sentinel: unrecognized reply prefix %q", line[0])
+	}
+}
+
+func fullRead(rd *bufio.Reader, buf []byte) (int, error) {
+	read := 0
+	for read < len(buf) {
+		n, err := rd.Read(buf[read:])
+		read += n
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+// Ping issues PING and reports whether sentinel answered PONG.
+func (s *SentinelClient) Ping() error {
+	reply, err := s.do("PING")
+	if err != nil {
+		return err
+	}
+	if str, ok := reply.(string); !ok || str != "PONG" {
+		return fmt.Errorf("sentinel: unexpected ping reply %+v", reply)
+	}
+	return nil
+}
+
+// GetMasterAddrByName asks sentinel for the current master of the named pod.
+func (s *SentinelClient) GetMasterAddrByName(name string) (string, int, error) {
+	reply, err := s.do("SENTINEL", "get-master-addr-by-name", name)
+	if err != nil {
+		return "", 0, err
+	}
+	items, ok := reply.([]interface{})
+	if !ok || len(items) != 2 {
+		return "", 0, fmt.Errorf("sentinel: no known master for pod %q", name)
+	}
+	ip, _ := items[0].(string)
+	portStr, _ := items[1].(string)
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, fmt.Errorf("sentinel: bad port for pod %q: %v", name, err)
+	}
+	return ip, port, nil
+}
+
+// Slaves asks sentinel for the slave list of the named pod.
+func (s *SentinelClient) Slaves(name string) ([]SentinelSlaveInfo, error) {
+	reply, err := s.do("SENTINEL", "slaves", name)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := reply.([]interface{})
+	if !ok {
+		return nil, nil
+	}
+	slaves := make([]SentinelSlaveInfo, 0, len(items))
+	for _, raw := range items {
+		fields, ok := raw.([]interface{})
+		if !ok {
+			continue
+		}
+		m := make(map[string]string)
+		for i := 0; i+1 < len(fields); i += 2 {
+			k, _ := fields[i].(string)
+			v, _ := fields[i+1].(string)
+			m[k] = v
+		}
+		port, _ := strconv.Atoi(m["port"])
+		slaves = append(slaves, SentinelSlaveInfo{IP: m["ip"], Port: port, Flags: m["flags"]})
+	}
+	return slaves, nil
+}
+
+// Subscribe issues SUBSCRIBE for the given channel names. The caller must
+// not issue further commands on this connection other than reading
+// messages with NextMessage.
+func (s *SentinelClient) Subscribe(channels ...string) error {
+	args := append([]string{"SUBSCRIBE"}, channels...)
+	if _, err := s.do(args...); err != nil {
+		return err
+	}
+	// SUBSCRIBE replies once per channel argument with a confirmation
+	// frame; do() already consumed the first, so drain the rest before
+	// NextMessage starts looking for real events.
+	for i := 1; i < len(channels); i++ {
+		if _, err := s.readReply(); err != nil {
+			return err
+		}
+	}
+	// The connection is now handed off to NextMessage, which blocks
+	// indefinitely between events. Clear the read deadline dialSentinelAddr
+	// set for the short-lived handshake, or every subscribed connection
+	// would time out and look like a lost sentinel a few seconds in.
+	s.conn.SetReadDeadline(time.Time{})
+	return nil
+}
+
+// SentinelEvent is a single pub/sub message received from sentinel, e.g.
+// channel "+switch-master" with payload "mymaster 10.0.0.1 6379 10.0.0.2 6379".
+type SentinelEvent struct {
+	Channel string
+	Payload string
+}
+
+// NextMessage blocks for the next pub/sub message on a subscribed
+// connection.
+func (s *SentinelClient) NextMessage() (SentinelEvent, error) {
+	reply, err := s.readReply()
+	if err != nil {
+		return SentinelEvent{}, err
+	}
+	items, ok := reply.([]interface{})
+	if !ok || len(items) < 3 {
+		return SentinelEvent{}, fmt.Errorf("sentinel: unexpected pub/sub reply %+v", reply)
+	}
+	kind, _ := items[0].(string)
+	if kind != "message" {
+		// subscribe confirmations and similar framing; caller just retries
+		return SentinelEvent{}, nil
+	}
+	channel, _ := items[1].(string)
+	payload, _ := items[2].(string)
+	return SentinelEvent{Channel: channel, Payload: payload}, nil
+}
+
+// localSentinelAddr returns host:port for the sentinel this process is
+// colocated with, per the parsed sentinel.conf. It is used as a fallback
+// when no seed list (CONFIGSYNC_SENTINELADDRS) is configured.
+func localSentinelAddr() string {
+	host := sconfig.Host
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return fmt.Sprintf("%s:%d", host, sconfig.Port)
+}
+
+// sentinelAddrsMu guards rotation of config.SentinelAddrs; dialSentinel can
+// be called concurrently from the daemon's sweep ticker and its event loop.
+var sentinelAddrsMu sync.Mutex
+
+// dialSentinel walks the configured sentinel seed list (falling back to the
+// address parsed from sentinel.conf if the list is empty), trying each
+// address in turn until one answers PING with PONG. The address that
+// answers is promoted to the head of the list so subsequent calls try it
+// first, mirroring go-redis' sentinelFailover rotation.
+func dialSentinel() (*SentinelClient, error) {
+	sentinelAddrsMu.Lock()
+	addrs := config.SentinelAddrs
+	sentinelAddrsMu.Unlock()
+
+	hasSeedList := len(addrs) > 0
+	if !hasSeedList {
+		addrs = []string{localSentinelAddr()}
+	}
+
+	var lastErr error
+	for i, addr := range addrs {
+		client, err := dialSentinelAddr(addr)
+		if err != nil {
+			lastErr = err
+			logger.Warning(fmt.Sprintf("dialSentinel: %s unreachable: %v", addr, err))
+			continue
+		}
+		if err := client.Ping(); err != nil {
+			client.Close()
+			lastErr = err
+			logger.Warning(fmt.Sprintf("dialSentinel: %s did not answer PING: %v", addr, err))
+			continue
+		}
+		if i > 0 && hasSeedList {
+			promoteSentinelAddr(addr)
+		}
+		return client, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no sentinel addresses configured")
+	}
+	return nil, fmt.Errorf("dialSentinel: no reachable sentinel in %v: %v", addrs, lastErr)
+}
+
+// dialSentinelAddr dials a single sentinel address honoring
+// config.DialTimeout/ReadTimeout, wrapping the connection in TLS and
+// authenticating with CONFIGSYNC_SENTINEL_USERNAME/PASSWORD when
+// configured.
+func dialSentinelAddr(addr string) (*SentinelClient, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeoutDuration(config.DialTimeout))
+	if err != nil {
+		return nil, err
+	}
+	if sconfig.TLSConfig != nil {
+		conn = tls.Client(conn, sconfig.TLSConfig)
+	}
+	if config.ReadTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeoutDuration(config.ReadTimeout)))
+	}
+	s := &SentinelClient{addr: addr, conn: conn, rd: bufio.NewReader(conn)}
+	if config.SentinelPassword != "" {
+		if err := s.auth(config.SentinelUsername, config.SentinelPassword); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// auth issues AUTH (or AUTH user pass, for Redis 6+ ACL users) on a freshly
+// dialed sentinel connection.
+func (s *SentinelClient) auth(username, password string) error {
+	var reply interface{}
+	var err error
+	if username != "" {
+		reply, err = s.do("AUTH", username, password)
+	} else {
+		reply, err = s.do("AUTH", password)
+	}
+	if err != nil {
+		return err
+	}
+	if str, ok := reply.(string); !ok || str != "OK" {
+		return fmt.Errorf("sentinel: AUTH failed: %+v", reply)
+	}
+	return nil
+}
+
+// promoteSentinelAddr moves addr to the front of config.SentinelAddrs.
+func promoteSentinelAddr(addr string) {
+	sentinelAddrsMu.Lock()
+	defer sentinelAddrsMu.Unlock()
+	addrs := config.SentinelAddrs
+	for i, a := range addrs {
+		if a == addr {
+			if i == 0 {
+				return
+			}
+			rotated := append([]string{addr}, append(append([]string{}, addrs[:i]...), addrs[i+1:]...)...)
+			config.SentinelAddrs = rotated
+			return
+		}
+	}
+}
+
+// timeoutDuration is a small helper so dial/read timeouts can be expressed
+// as plain seconds in config without pulling in a duration parser.
+func timeoutDuration(seconds int) time.Duration {
+	return time.Duration(seconds) * time.Second
+}
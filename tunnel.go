@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// TunnelPodConfig describes one pod's local listener, as loaded from the
+// tunnel subcommand's JSON config file, e.g.:
+//
+//	[{"Name": "mymaster", "LocalPort": 7000}]
+type TunnelPodConfig struct {
+	Name      string
+	LocalPort int
+}
+
+// tunnel proxies local connections for a single pod to whichever instance
+// sentinel currently reports as master, so clients that cannot speak the
+// Sentinel protocol still benefit from failover routing.
+type tunnel struct {
+	pod   TunnelPodConfig
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func newTunnel(pod TunnelPodConfig) *tunnel {
+	return &tunnel{pod: pod, conns: make(map[net.Conn]struct{})}
+}
+
+func (t *tunnel) track(c net.Conn) {
+	t.mu.Lock()
+	t.conns[c] = struct{}{}
+	t.mu.Unlock()
+}
+
+func (t *tunnel) untrack(c net.Conn) {
+	t.mu.Lock()
+	delete(t.conns, c)
+	t.mu.Unlock()
+}
+
+// dropAll closes every connection currently proxied for this pod, forcing
+// clients to reconnect and pick up the new master.
+func (t *tunnel) dropAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for c := range t.conns {
+		c.Close()
+	}
+	t.conns = make(map[net.Conn]struct{})
+}
+
+// listen accepts local connections for t.pod and proxies each to the
+// current master. It blocks until listening fails.
+func (t *tunnel) listen() error {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", t.pod.LocalPort))
+	if err != nil {
+		return err
+	}
+	logger.Info(fmt.Sprintf("tunnel: listening on :%d for pod %q", t.pod.LocalPort, t.pod.Name))
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go t.handleConn(conn)
+	}
+}
+
+func (t *tunnel) handleConn(client net.Conn) {
+	sentinel, err := dialSentinel()
+	if err != nil {
+		logger.Warning(fmt.Sprintf("tunnel: unable to reach sentinel for pod %q: %v", t.pod.Name, err))
+		client.Close()
+		return
+	}
+	ip, port, err := sentinel.GetMasterAddrByName(t.pod.Name)
+	sentinel.Close()
+	if err != nil {
+		logger.Warning(fmt.Sprintf("tunnel: unable to resolve master for pod %q: %v", t.pod.Name, err))
+		client.Close()
+		return
+	}
+	master, err := net.Dial("tcp", fmt.Sprintf("%s:%d", ip, port))
+	if err != nil {
+		logger.Warning(fmt.Sprintf("tunnel: unable to dial master for pod %q: %v", t.pod.Name, err))
+		client.Close()
+		return
+	}
+
+	t.track(client)
+	defer t.untrack(client)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(master, client)
+		master.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(client, master)
+		client.Close()
+	}()
+	wg.Wait()
+}
+
+// loadTunnelConfig reads the JSON tunnel config file listing the pods to
+// proxy and the local port each should listen on.
+func loadTunnelConfig(path string) ([]TunnelPodConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var pods []TunnelPodConfig
+	if err := json.NewDecoder(f).Decode(&pods); err != nil {
+		return nil, fmt.Errorf("unable to parse tunnel config %s: %v", path, err)
+	}
+	return pods, nil
+}
+
+// runTunnelCommand implements the `configsync tunnel` subcommand: it starts
+// one local listener per configured pod and keeps them pointed at the
+// current master, dropping live connections whenever sentinel reports a
+// switch-master for that pod.
+func runTunnelCommand(args []string) error {
+	fs := flag.NewFlagSet("tunnel", flag.ExitOnError)
+	configPath := fs.String("config", "/etc/redis/configsync-tunnel.json", "path to the tunnel JSON config file")
+	fs.Parse(args)
+
+	pods, err := loadTunnelConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if len(pods) == 0 {
+		return fmt.Errorf("tunnel config %s lists no pods", *configPath)
+	}
+
+	tunnels := make(map[string]*tunnel, len(pods))
+	for _, pod := range pods {
+		t := newTunnel(pod)
+		tunnels[pod.Name] = t
+		go func(t *tunnel) {
+			if err := t.listen(); err != nil {
+				logger.Crit(fmt.Sprintf("tunnel: listener for pod %q died: %v", t.pod.Name, err))
+				os.Exit(1)
+			}
+		}(t)
+	}
+
+	watchSwitchMaster(tunnels)
+	return nil
+}
+
+// watchSwitchMaster subscribes to sentinel's +switch-master events and
+// drops live tunnel connections for whichever pod just failed over, the
+// same reconnect-with-backoff pattern used by daemon mode.
+func watchSwitchMaster(tunnels map[string]*tunnel) {
+	backoff := backoffSeed()
+	for {
+		sentinel, err := dialSentinel()
+		if err != nil {
+			logger.Warning(fmt.Sprintf("tunnel: unable to connect to sentinel: %v (retrying in %s)", err, backoff))
+			sleep(backoff)
+			backoff = nextBackoff(backoff)
+			continue
+		}
+		if err := sentinel.Subscribe("+switch-master"); err != nil {
+			logger.Warning("tunnel: subscribe failed: " + err.Error())
+			sentinel.Close()
+			sleep(backoff)
+			backoff = nextBackoff(backoff)
+			continue
+		}
+		backoff = backoffSeed()
+
+		for {
+			event, err := sentinel.NextMessage()
+			if err != nil {
+				logger.Warning("tunnel: lost sentinel connection: " + err.Error())
+				break
+			}
+			fields := strings.Fields(event.Payload)
+			if len(fields) == 0 {
+				continue
+			}
+			podName := fields[0]
+			if t, ok := tunnels[podName]; ok {
+				logger.Info(fmt.Sprintf("tunnel: switch-master for pod %q, dropping live connections", podName))
+				t.dropAll()
+			}
+		}
+		sentinel.Close()
+		sleep(backoff)
+		backoff = nextBackoff(backoff)
+	}
+}